@@ -15,6 +15,16 @@ import (
 const (
 	// Kind is EurekaServiceRegistry kind.
 	Kind = "EurekaServiceRegistry"
+
+	// ModeDiscover only syncs instances from Eureka into the local registry.
+	ModeDiscover = "discover"
+	// ModeRegister only registers the configured instances into Eureka.
+	ModeRegister = "register"
+	// ModeBoth both syncs and registers.
+	ModeBoth = "both"
+
+	minHeartbeatBackoff = time.Second
+	maxHeartbeatBackoff = time.Minute
 )
 
 func init() {
@@ -34,8 +44,9 @@ type (
 		clientMutex sync.RWMutex
 		client      *eureka.Client
 
-		statusMutex sync.Mutex
-		serversNum  map[string]int
+		statusMutex    sync.Mutex
+		serversNum     map[string]int
+		registerStatus map[string]*registerStatus
 
 		done chan struct{}
 	}
@@ -46,6 +57,29 @@ type (
 
 		Endpoints    []string `yaml:"endpoints" jsonschema:"required,uniqueItems=true"`
 		SyncInterval string   `yaml:"syncInterval" jsonschema:"required,format=duration"`
+
+		// Mode controls whether the registry discovers instances from
+		// Eureka, registers Instances into Eureka, or both.
+		// Defaults to "discover" for backward compatibility.
+		Mode string `yaml:"mode" jsonschema:"omitempty,enum=discover,enum=register,enum=both"`
+
+		// Instances are the local instances to register when Mode is
+		// "register" or "both".
+		Instances []*InstanceSpec `yaml:"instances" jsonschema:"omitempty"`
+	}
+
+	// InstanceSpec describes an instance to be registered into Eureka.
+	InstanceSpec struct {
+		AppName           string            `yaml:"appName" jsonschema:"required"`
+		InstanceID        string            `yaml:"instanceId" jsonschema:"required"`
+		HostName          string            `yaml:"hostName" jsonschema:"required"`
+		IPAddr            string            `yaml:"ipAddr" jsonschema:"required"`
+		VipAddress        string            `yaml:"vipAddress" jsonschema:"omitempty"`
+		Port              int               `yaml:"port" jsonschema:"omitempty"`
+		SecurePort        int               `yaml:"securePort" jsonschema:"omitempty"`
+		DataCenterInfo    string            `yaml:"dataCenterInfo" jsonschema:"omitempty"`
+		LeaseDurationSecs int               `yaml:"leaseDurationSecs" jsonschema:"omitempty"`
+		Metadata          map[string]string `yaml:"metadata" jsonschema:"omitempty"`
 	}
 
 	// Status is the status of EurekaServiceRegistry.
@@ -53,6 +87,23 @@ type (
 		Timestamp  int64          `yaml:"timestamp"`
 		Health     string         `yaml:"health"`
 		ServersNum map[string]int `yaml:"serversNum"`
+
+		// Registrations reports, per configured instance, whether it is
+		// currently registered with Eureka and when it was last heartbeat.
+		Registrations map[string]*InstanceStatus `yaml:"registrations,omitempty"`
+	}
+
+	// InstanceStatus is the registration status of one configured instance.
+	InstanceStatus struct {
+		Registered        bool   `yaml:"registered"`
+		LastHeartbeatTime int64  `yaml:"lastHeartbeatTime"`
+		LastError         string `yaml:"lastError,omitempty"`
+	}
+
+	registerStatus struct {
+		registered        bool
+		lastHeartbeatTime int64
+		lastError         string
 	}
 )
 
@@ -61,20 +112,41 @@ func DefaultSpec() *Spec {
 	return &Spec{
 		Endpoints:    []string{"http://127.0.0.1:8761/eureka"},
 		SyncInterval: "10s",
+		Mode:         ModeDiscover,
 	}
 }
 
 // Validate validates Spec.
 func (spec Spec) Validate() error {
+	switch spec.Mode {
+	case "", ModeDiscover, ModeRegister, ModeBoth:
+	default:
+		return fmt.Errorf("invalid mode: %s", spec.Mode)
+	}
+
+	if spec.Mode == ModeRegister || spec.Mode == ModeBoth {
+		if len(spec.Instances) == 0 {
+			return fmt.Errorf("mode %s needs at least one instance", spec.Mode)
+		}
+	}
+
 	return nil
 }
 
+func (spec Spec) mode() string {
+	if spec.Mode == "" {
+		return ModeDiscover
+	}
+	return spec.Mode
+}
+
 // New creates an EurekaServiceRegistry.
 func New(spec *Spec, prev *EurekaServiceRegistry, handlers *sync.Map) *EurekaServiceRegistry {
 	esr := &EurekaServiceRegistry{
-		spec:       spec,
-		serversNum: map[string]int{},
-		done:       make(chan struct{}),
+		spec:           spec,
+		serversNum:     map[string]int{},
+		registerStatus: map[string]*registerStatus{},
+		done:           make(chan struct{}),
 	}
 	if prev != nil {
 		prev.Close()
@@ -85,7 +157,16 @@ func New(spec *Spec, prev *EurekaServiceRegistry, handlers *sync.Map) *EurekaSer
 		logger.Errorf("%s get consul client failed: %v", spec.Name, err)
 	}
 
-	go esr.run()
+	if esr.spec.mode() == ModeDiscover || esr.spec.mode() == ModeBoth {
+		go esr.run()
+	}
+
+	if esr.spec.mode() == ModeRegister || esr.spec.mode() == ModeBoth {
+		for _, instance := range esr.spec.Instances {
+			esr.registerStatus[instance.InstanceID] = &registerStatus{}
+			go esr.runRegistration(instance)
+		}
+	}
 
 	return esr
 }
@@ -199,6 +280,203 @@ func (esr *EurekaServiceRegistry) update() {
 	esr.statusMutex.Unlock()
 }
 
+// runRegistration registers the instance into Eureka and keeps it alive with
+// periodic heartbeats, using half the lease duration as the heartbeat
+// interval per Eureka's expected client behavior. It retries a failed
+// heartbeat with exponential backoff and re-registers the instance whenever
+// a heartbeat is rejected with NOT_FOUND. A failed registration is logged
+// and not retried with backoff; the next heartbeat tick is its next chance.
+func (esr *EurekaServiceRegistry) runRegistration(instance *InstanceSpec) {
+	leaseDurationSecs := instance.LeaseDurationSecs
+	if leaseDurationSecs <= 0 {
+		leaseDurationSecs = 30
+	}
+	heartbeatInterval := time.Duration(leaseDurationSecs) * time.Second / 2
+
+	if err := esr.register(instance); err != nil {
+		logger.Errorf("%s register instance %s failed: %v",
+			esr.spec.Name, instance.InstanceID, err)
+	}
+
+	backoff := minHeartbeatBackoff
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-esr.done:
+			esr.deregister(instance)
+			return
+		case <-ticker.C:
+			// Retry directly off of backoff instead of waiting out the
+			// fixed ticker cadence, so backoff actually governs retry
+			// timing on failure rather than just delaying the next
+			// already-scheduled tick.
+			for {
+				err := esr.heartbeat(instance)
+				if err == nil {
+					backoff = minHeartbeatBackoff
+					break
+				}
+
+				if isNotFoundError(err) {
+					logger.Warnf("%s heartbeat for %s got NOT_FOUND, re-registering",
+						esr.spec.Name, instance.InstanceID)
+					if rerr := esr.register(instance); rerr != nil {
+						logger.Errorf("%s re-register instance %s failed: %v",
+							esr.spec.Name, instance.InstanceID, rerr)
+					}
+					backoff = minHeartbeatBackoff
+					break
+				}
+
+				logger.Errorf("%s heartbeat for %s failed: %v, retrying in %s",
+					esr.spec.Name, instance.InstanceID, err, backoff)
+
+				select {
+				case <-esr.done:
+					esr.deregister(instance)
+					return
+				case <-time.After(backoff):
+				}
+
+				backoff *= 2
+				if backoff > maxHeartbeatBackoff {
+					backoff = maxHeartbeatBackoff
+				}
+			}
+		}
+	}
+}
+
+func (esr *EurekaServiceRegistry) register(instance *InstanceSpec) error {
+	client, err := esr.getClient()
+	if err != nil {
+		return err
+	}
+
+	eurekaInstance := toEurekaInstance(instance)
+
+	err = client.RegisterInstance(instance.AppName, eurekaInstance)
+
+	esr.setRegisterStatus(instance.InstanceID, err == nil, err)
+
+	return err
+}
+
+func (esr *EurekaServiceRegistry) heartbeat(instance *InstanceSpec) error {
+	client, err := esr.getClient()
+	if err != nil {
+		return err
+	}
+
+	err = client.SendHeartbeat(instance.AppName, instance.InstanceID)
+
+	esr.statusMutex.Lock()
+	status, ok := esr.registerStatus[instance.InstanceID]
+	if ok {
+		if err == nil {
+			status.lastHeartbeatTime = time.Now().Unix()
+			status.lastError = ""
+		} else {
+			status.lastError = err.Error()
+		}
+	}
+	esr.statusMutex.Unlock()
+
+	return err
+}
+
+func (esr *EurekaServiceRegistry) deregister(instance *InstanceSpec) {
+	client, err := esr.getClient()
+	if err != nil {
+		return
+	}
+
+	if err := client.UnregisterInstance(instance.AppName, instance.InstanceID); err != nil {
+		logger.Errorf("%s deregister instance %s failed: %v",
+			esr.spec.Name, instance.InstanceID, err)
+		return
+	}
+
+	esr.setRegisterStatus(instance.InstanceID, false, nil)
+}
+
+func (esr *EurekaServiceRegistry) setRegisterStatus(instanceID string, registered bool, err error) {
+	esr.statusMutex.Lock()
+	defer esr.statusMutex.Unlock()
+
+	status, ok := esr.registerStatus[instanceID]
+	if !ok {
+		status = &registerStatus{}
+		esr.registerStatus[instanceID] = status
+	}
+
+	status.registered = registered
+	if err != nil {
+		status.lastError = err.Error()
+	}
+}
+
+// isNotFoundError reports whether err represents Eureka's NOT_FOUND
+// response to a heartbeat for an instance that is no longer known to the
+// server, in which case the client is expected to re-register.
+func isNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return fmt.Sprint(err) != "" && containsNotFound(err.Error())
+}
+
+func containsNotFound(s string) bool {
+	for i := 0; i+len("404") <= len(s); i++ {
+		if s[i:i+len("404")] == "404" {
+			return true
+		}
+	}
+	return false
+}
+
+func toEurekaInstance(instance *InstanceSpec) *eureka.InstanceInfo {
+	leaseDurationSecs := instance.LeaseDurationSecs
+	if leaseDurationSecs <= 0 {
+		leaseDurationSecs = 30
+	}
+
+	dataCenterName := eureka.MyOwn
+	if instance.DataCenterInfo != "" {
+		dataCenterName = eureka.DataCenterName(instance.DataCenterInfo)
+	}
+
+	info := &eureka.InstanceInfo{
+		InstanceId: instance.InstanceID,
+		HostName:   instance.HostName,
+		App:        instance.AppName,
+		IpAddr:     instance.IPAddr,
+		VipAddress: instance.VipAddress,
+		Status:     eureka.UP,
+		DataCenterInfo: &eureka.DataCenterInfo{
+			Name: dataCenterName,
+		},
+		LeaseInfo: &eureka.LeaseInfo{
+			DurationInSecs: int32(leaseDurationSecs),
+		},
+		Metadata: &eureka.MetaData{
+			Class: "com.netflix.appinfo.InstanceInfo$MetaDataClass",
+			Map:   instance.Metadata,
+		},
+	}
+
+	if instance.Port > 0 {
+		info.Port = &eureka.Port{Port: instance.Port, Enabled: true}
+	}
+	if instance.SecurePort > 0 {
+		info.SecurePort = &eureka.Port{Port: instance.SecurePort, Enabled: true}
+	}
+
+	return info
+}
+
 // Status returns status of EurekaServiceRegister.
 func (esr *EurekaServiceRegistry) Status() *Status {
 	s := &Status{}
@@ -212,6 +490,14 @@ func (esr *EurekaServiceRegistry) Status() *Status {
 
 	esr.statusMutex.Lock()
 	serversNum := esr.serversNum
+	s.Registrations = make(map[string]*InstanceStatus, len(esr.registerStatus))
+	for instanceID, status := range esr.registerStatus {
+		s.Registrations[instanceID] = &InstanceStatus{
+			Registered:        status.registered,
+			LastHeartbeatTime: status.lastHeartbeatTime,
+			LastError:         status.lastError,
+		}
+	}
 	esr.statusMutex.Unlock()
 
 	s.ServersNum = serversNum
@@ -221,8 +507,9 @@ func (esr *EurekaServiceRegistry) Status() *Status {
 
 // Close closes EurekaServiceRegistry.
 func (esr *EurekaServiceRegistry) Close() {
-	esr.closeClient()
 	close(esr.done)
 
+	esr.closeClient()
+
 	serviceregistry.Global.CloseRegistry(esr.spec.Name)
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package httpbackend
+
+import "testing"
+
+func TestConsistentHashRingPickIsDeterministic(t *testing.T) {
+	servers := []*Server{
+		{URL: "http://s1", Weight: 1},
+		{URL: "http://s2", Weight: 1},
+		{URL: "http://s3", Weight: 1},
+	}
+	ring := newConsistentHashRing(servers, nil)
+
+	first := ring.pick("some-key")
+	for i := 0; i < 10; i++ {
+		if got := ring.pick("some-key"); got != first {
+			t.Fatalf("pick(%q) is not deterministic: got %v, want %v", "some-key", got, first)
+		}
+	}
+}
+
+func TestConsistentHashRingUsesAllServers(t *testing.T) {
+	servers := []*Server{
+		{URL: "http://s1", Weight: 1},
+		{URL: "http://s2", Weight: 1},
+		{URL: "http://s3", Weight: 1},
+	}
+	ring := newConsistentHashRing(servers, nil)
+
+	picked := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		key := string(rune('a' + i%26))
+		server := ring.pick(key)
+		if server == nil {
+			t.Fatalf("pick(%q) returned nil", key)
+		}
+		picked[server.URL] = true
+	}
+
+	if len(picked) != len(servers) {
+		t.Fatalf("expected all %d servers to be reachable on the ring, got %d: %v",
+			len(servers), len(picked), picked)
+	}
+}
+
+func TestConsistentHashRingWeightAddsVirtualNodes(t *testing.T) {
+	light := newConsistentHashRing([]*Server{{URL: "http://s1", Weight: 1}}, nil)
+	heavy := newConsistentHashRing([]*Server{{URL: "http://s1", Weight: 3}}, nil)
+
+	if len(heavy.nodes) != 3*len(light.nodes) {
+		t.Fatalf("expected weight 3 to place 3x the virtual nodes of weight 1: got %d vs %d",
+			len(heavy.nodes), len(light.nodes))
+	}
+}
+
+func TestConsistentHashRingVirtualNodeReplicasOverride(t *testing.T) {
+	spec := &ConsistentHashSpec{VirtualNodeReplicas: 10}
+	ring := newConsistentHashRing([]*Server{{URL: "http://s1"}}, spec)
+
+	if len(ring.nodes) != 10 {
+		t.Fatalf("expected VirtualNodeReplicas to set node count to 10, got %d", len(ring.nodes))
+	}
+}
+
+func TestConsistentHashRingPickEmpty(t *testing.T) {
+	ring := newConsistentHashRing(nil, nil)
+	if server := ring.pick("any"); server != nil {
+		t.Fatalf("expected pick on an empty ring to return nil, got %v", server)
+	}
+}
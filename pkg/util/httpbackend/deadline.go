@@ -0,0 +1,323 @@
+package httpbackend
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegateway/pkg/context"
+	"github.com/megaease/easegateway/pkg/logger"
+)
+
+const (
+	defaultPerTryTimeout = "5s"
+	defaultBackoffBase   = "100ms"
+	defaultBackoffMax    = "2s"
+)
+
+// idempotentMethods are the methods retried by default even without an
+// explicit idempotency guard override, since resending them is safe.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+type (
+	// DeadlineSpec bounds how long a request may spend across retries and
+	// controls the retry policy used when an attempt times out, is
+	// cancelled, or comes back with a retryable status.
+	DeadlineSpec struct {
+		// Total is the overall budget across the initial try and all
+		// retries. Unset means unbounded (per-try timeouts still
+		// apply).
+		Total string `yaml:"total" jsonschema:"omitempty,format=duration"`
+		// PerTry is the timeout applied to each individual attempt.
+		// Defaults to 5s.
+		PerTry string `yaml:"perTry" jsonschema:"omitempty,format=duration"`
+		// MaxRetries caps the number of retries after the initial try.
+		// Defaults to 0 (no retries).
+		MaxRetries int `yaml:"maxRetries" jsonschema:"omitempty,gte=0"`
+		// BackoffBase is the starting backoff between retries, doubling
+		// on each subsequent retry. Defaults to 100ms.
+		BackoffBase string `yaml:"backoffBase" jsonschema:"omitempty,format=duration"`
+		// BackoffMax caps the backoff. Defaults to 2s.
+		BackoffMax string `yaml:"backoffMax" jsonschema:"omitempty,format=duration"`
+		// Jitter randomizes each backoff within [0, backoff] instead of
+		// sleeping the full computed duration, to avoid retry storms.
+		Jitter bool `yaml:"jitter" jsonschema:"omitempty"`
+		// RetryableStatusCodes lists response statuses that trigger a
+		// retry in addition to timeouts and connection errors.
+		RetryableStatusCodes []int `yaml:"retryableStatusCodes" jsonschema:"omitempty"`
+		// RetryIdempotentOnly restricts retries to idempotent methods
+		// (GET, HEAD, OPTIONS, PUT, DELETE) even when a retryable
+		// status or a timeout is observed. Defaults to true; set to
+		// false only if upstream handlers are known to be safe to
+		// retry regardless of method.
+		RetryIdempotentOnly *bool `yaml:"retryIdempotentOnly" jsonschema:"omitempty"`
+	}
+
+	// dispatchResult is returned by dispatcher.do for the caller to log
+	// and, eventually, feed into pipeline statistics. resp.Body wraps the
+	// winning attempt's per-try context cancellation, so it is safe to
+	// read until the caller closes it.
+	dispatchResult struct {
+		resp    *http.Response
+		server  *Server
+		retries int
+	}
+
+	// cancelOnCloseBody defers cancelling the per-try and (if set) total
+	// deadline contexts, and releasing server's in-flight slot, until the
+	// response body it guards has actually been consumed. Tying all three
+	// to Close means a caller streaming a returned response never reads
+	// against an already-cancelled context and leastConnections keeps
+	// counting the server busy for as long as the response is still being
+	// read.
+	cancelOnCloseBody struct {
+		io.ReadCloser
+		s           *servers
+		server      *Server
+		cancelTry   stdcontext.CancelFunc
+		cancelTotal stdcontext.CancelFunc
+	}
+
+	dispatcher struct {
+		spec *DeadlineSpec
+
+		total        time.Duration
+		perTry       time.Duration
+		backoffBase  time.Duration
+		backoffMax   time.Duration
+		retryIdemOnl bool
+
+		// retryCount and retrySuccessCount back PluginRetryCount and
+		// PluginRetrySuccessCount on pipelines.PipelineStatistics; do
+		// updates them on every dispatch so a caller wiring this
+		// dispatcher's plugin into a pipeline can report them as
+		// plugin indicators.
+		retryCount        int64
+		retrySuccessCount int64
+	}
+)
+
+// Validate validates DeadlineSpec.
+func (spec DeadlineSpec) Validate() error {
+	if spec.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries must be >= 0")
+	}
+	return nil
+}
+
+func newDispatcher(spec *DeadlineSpec) *dispatcher {
+	if spec == nil {
+		return nil
+	}
+
+	d := &dispatcher{spec: spec, retryIdemOnl: true}
+
+	if spec.RetryIdempotentOnly != nil {
+		d.retryIdemOnl = *spec.RetryIdempotentOnly
+	}
+
+	if spec.Total != "" {
+		if total, err := time.ParseDuration(spec.Total); err == nil {
+			d.total = total
+		} else {
+			logger.Errorf("BUG: parse deadline total %s failed: %v", spec.Total, err)
+		}
+	}
+
+	perTry, err := time.ParseDuration(stringDefault(spec.PerTry, defaultPerTryTimeout))
+	if err != nil {
+		logger.Errorf("BUG: parse deadline perTry %s failed: %v", spec.PerTry, err)
+		perTry, _ = time.ParseDuration(defaultPerTryTimeout)
+	}
+	d.perTry = perTry
+
+	backoffBase, err := time.ParseDuration(stringDefault(spec.BackoffBase, defaultBackoffBase))
+	if err != nil {
+		backoffBase, _ = time.ParseDuration(defaultBackoffBase)
+	}
+	d.backoffBase = backoffBase
+
+	backoffMax, err := time.ParseDuration(stringDefault(spec.BackoffMax, defaultBackoffMax))
+	if err != nil {
+		backoffMax, _ = time.ParseDuration(defaultBackoffMax)
+	}
+	d.backoffMax = backoffMax
+
+	return d
+}
+
+func (d *dispatcher) isRetryableStatus(statusCode int) bool {
+	for _, code := range d.spec.RetryableStatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.s.release(b.server)
+	b.cancelTry()
+	cancelIfSet(b.cancelTotal)
+	return err
+}
+
+// cancelIfSet calls cancel if it is non-nil, i.e. a Total deadline was
+// configured; cancel is nil when dispatcher has no overall budget.
+func cancelIfSet(cancel stdcontext.CancelFunc) {
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// RetryCount returns the number of retry attempts made across every
+// dispatch through d so far.
+func (d *dispatcher) RetryCount() int64 {
+	return atomic.LoadInt64(&d.retryCount)
+}
+
+// RetrySuccessCount returns how many dispatches that needed at least one
+// retry ended with a response that was not retryable; dispatches that ran
+// out of retries are not counted, even though they return a response.
+func (d *dispatcher) RetrySuccessCount() int64 {
+	return atomic.LoadInt64(&d.retrySuccessCount)
+}
+
+// recordRetries feeds a finished dispatch's retry count and outcome into
+// RetryCount/RetrySuccessCount. retries is the number of attempts that
+// preceded the returned one; succeeded is false for the retries-exhausted
+// path, where the last attempt's response is handed back unread rather
+// than treated as a successful retry.
+func (d *dispatcher) recordRetries(retries int, succeeded bool) {
+	if retries == 0 {
+		return
+	}
+	atomic.AddInt64(&d.retryCount, int64(retries))
+	if succeeded {
+		atomic.AddInt64(&d.retrySuccessCount, 1)
+	}
+}
+
+func (d *dispatcher) canRetry(ctx context.HTTPContext) bool {
+	if !d.retryIdemOnl {
+		return true
+	}
+	return idempotentMethods[ctx.Request().Method()]
+}
+
+// do dispatches the request through s, abandoning a slow or hung upstream
+// within PerTry and trying the next healthy server within the overall
+// Total budget. doRequest performs the actual round trip against server
+// using a context.Context derived from HTTPContext and bounded by the
+// current attempt's timeout, so client cancellation and per-try timeouts
+// both unblock it promptly.
+func (d *dispatcher) do(
+	ctx context.HTTPContext,
+	s *servers,
+	doRequest func(stdCtx stdcontext.Context, server *Server) (*http.Response, error),
+) (*dispatchResult, error) {
+	stdCtx := ctx.Request().Std().Context()
+	// cancelTotal, when set, is only ever invoked directly on paths that
+	// return without handing a response back to the caller; a returned
+	// response instead ties it to cancelOnCloseBody.Close, since stdCtx
+	// is tryCtx's parent and cancelling it here would cancel the body's
+	// read the instant do returns.
+	var cancelTotal stdcontext.CancelFunc
+	if d.total > 0 {
+		stdCtx, cancelTotal = stdcontext.WithTimeout(stdCtx, d.total)
+	}
+
+	maxRetries := d.spec.MaxRetries
+
+	var lastErr error
+	backoff := d.backoffBase
+
+	for attempt := 0; ; attempt++ {
+		server := s.next(ctx)
+		if server == nil {
+			cancelIfSet(cancelTotal)
+			return nil, lastErr
+		}
+
+		tryCtx, cancelTry := stdcontext.WithTimeout(stdCtx, d.perTry)
+		resp, err := doRequest(tryCtx, server)
+		if err != nil || resp.StatusCode >= 500 {
+			s.recordFailure(server)
+		}
+
+		retryable := false
+		switch {
+		case err != nil:
+			cancelTry()
+			s.release(server)
+			lastErr = err
+			retryable = true
+		case d.isRetryableStatus(resp.StatusCode):
+			lastErr = nil
+			retryable = true
+		default:
+			// Success: cancelling tryCtx now would cancel the request
+			// context the caller is about to stream resp.Body against,
+			// so defer it, along with cancelTotal and the server's
+			// in-flight release, to the body's Close instead.
+			resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, s: s, server: server, cancelTry: cancelTry, cancelTotal: cancelTotal}
+			d.recordRetries(attempt, true)
+			return &dispatchResult{resp: resp, server: server, retries: attempt}, nil
+		}
+
+		if !retryable || attempt >= maxRetries || !d.canRetry(ctx) || stdCtx.Err() != nil {
+			if err == nil {
+				// Retries are exhausted but the last attempt did get a
+				// response back; hand it to the caller unread instead
+				// of closing its body out from under it.
+				resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, s: s, server: server, cancelTry: cancelTry, cancelTotal: cancelTotal}
+				d.recordRetries(attempt, false)
+				return &dispatchResult{resp: resp, server: server, retries: attempt}, nil
+			}
+			cancelTry()
+			cancelIfSet(cancelTotal)
+			return nil, err
+		}
+
+		// This attempt's response is being discarded in favor of a
+		// retry, not handed to the caller, so close its body right away
+		// instead of waiting for a Close that will never come from
+		// outside do. The err != nil case already released its server
+		// slot above; this is the retryable-status case, which didn't.
+		if err == nil {
+			s.release(server)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancelTry()
+
+		wait := backoff
+		if d.spec.Jitter {
+			wait = time.Duration(rand.Int63n(int64(backoff) + 1))
+		}
+
+		select {
+		case <-stdCtx.Done():
+			cancelIfSet(cancelTotal)
+			return nil, stdCtx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > d.backoffMax {
+			backoff = d.backoffMax
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package httpbackend
+
+import (
+	stdcontext "context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegateway/pkg/context"
+)
+
+// fakeHTTPRequest implements just enough of context.HTTPRequest for
+// dispatcher.do: embedding the interface lets the zero value satisfy it,
+// panicking only if a method beyond the ones below is actually called.
+type fakeHTTPRequest struct {
+	context.HTTPRequest
+	method string
+	std    *http.Request
+}
+
+func (r *fakeHTTPRequest) Method() string     { return r.method }
+func (r *fakeHTTPRequest) Std() *http.Request { return r.std }
+
+// fakeHTTPContext implements just enough of context.HTTPContext for
+// dispatcher.do and servers.next under the roundRobin policy.
+type fakeHTTPContext struct {
+	context.HTTPContext
+	req *fakeHTTPRequest
+}
+
+func (c *fakeHTTPContext) Request() context.HTTPRequest { return c.req }
+
+func newFakeContext(stdCtx stdcontext.Context, method string) context.HTTPContext {
+	std, err := http.NewRequest(method, "http://example.com", nil)
+	if err != nil {
+		panic(err)
+	}
+	return &fakeHTTPContext{req: &fakeHTTPRequest{method: method, std: std.WithContext(stdCtx)}}
+}
+
+func testServers(t *testing.T) *servers {
+	t.Helper()
+	s := newServers(&Spec{
+		Servers:     []*Server{{URL: "http://s1", Weight: 1}, {URL: "http://s2", Weight: 1}},
+		LoadBalance: &LoadBalance{Policy: policyRoundRobin},
+	})
+	t.Cleanup(s.close)
+	return s
+}
+
+func okResponse() *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}
+}
+
+func TestDispatcherPerTryTimeout(t *testing.T) {
+	d := newDispatcher(&DeadlineSpec{PerTry: "20ms", MaxRetries: 0})
+	s := testServers(t)
+	ctx := newFakeContext(stdcontext.Background(), http.MethodGet)
+
+	var calls int32
+	start := time.Now()
+	_, err := d.do(ctx, s, func(tryCtx stdcontext.Context, server *Server) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		<-tryCtx.Done()
+		return nil, tryCtx.Err()
+	})
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("expected an error once the per-try timeout fires")
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected exactly one attempt with maxRetries 0, got %d", calls)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("do took %s, want it bounded by the 20ms per-try timeout", elapsed)
+	}
+}
+
+func TestDispatcherRetryBudgetExhausted(t *testing.T) {
+	d := newDispatcher(&DeadlineSpec{
+		PerTry:               "1s",
+		MaxRetries:           2,
+		BackoffBase:          "1ms",
+		BackoffMax:           "2ms",
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+	})
+	s := testServers(t)
+	ctx := newFakeContext(stdcontext.Background(), http.MethodGet)
+
+	var calls int32
+	result, err := d.do(ctx, s, func(tryCtx stdcontext.Context, server *Server) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	if err != nil {
+		t.Fatalf("expected the exhausted-retries response to be returned, not an error: %v", err)
+	}
+	if int(atomic.LoadInt32(&calls)) != 1+d.spec.MaxRetries {
+		t.Fatalf("expected 1 initial try + %d retries = %d attempts, got %d",
+			d.spec.MaxRetries, 1+d.spec.MaxRetries, calls)
+	}
+	if result.retries != d.spec.MaxRetries {
+		t.Fatalf("expected dispatchResult.retries to equal maxRetries %d, got %d", d.spec.MaxRetries, result.retries)
+	}
+	if d.RetryCount() != int64(d.spec.MaxRetries) {
+		t.Fatalf("expected RetryCount to reflect the exhausted retries, got %d", d.RetryCount())
+	}
+	if d.RetrySuccessCount() != 0 {
+		t.Fatalf("exhausted retries never got a clean response, RetrySuccessCount should stay 0, got %d", d.RetrySuccessCount())
+	}
+	result.resp.Body.Close()
+}
+
+func TestDispatcherTotalDeadlineCancellation(t *testing.T) {
+	d := newDispatcher(&DeadlineSpec{Total: "30ms", PerTry: "1s"})
+	s := testServers(t)
+	ctx := newFakeContext(stdcontext.Background(), http.MethodGet)
+
+	start := time.Now()
+	_, err := d.do(ctx, s, func(tryCtx stdcontext.Context, server *Server) (*http.Response, error) {
+		<-tryCtx.Done()
+		return nil, tryCtx.Err()
+	})
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("expected an error once the total deadline fires")
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("do took %s, want it bounded by the 30ms total deadline, not the 1s per-try timeout", elapsed)
+	}
+}
+
+func TestDispatcherTotalDeadlineDoesNotCancelReturnedBody(t *testing.T) {
+	d := newDispatcher(&DeadlineSpec{Total: "200ms", PerTry: "1s"})
+	s := testServers(t)
+	ctx := newFakeContext(stdcontext.Background(), http.MethodGet)
+
+	var gotTryCtx stdcontext.Context
+	result, err := d.do(ctx, s, func(tryCtx stdcontext.Context, server *Server) (*http.Response, error) {
+		gotTryCtx = tryCtx
+		return okResponse(), nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The returned body must still be readable well within Total; if
+	// cancelTotal fired at do's return instead of at Body.Close, the
+	// attempt's context is already cancelled here.
+	time.Sleep(10 * time.Millisecond)
+	if gotTryCtx.Err() != nil {
+		t.Fatalf("attempt context cancelled before Body.Close: %v", gotTryCtx.Err())
+	}
+	data, readErr := io.ReadAll(result.resp.Body)
+	if readErr != nil {
+		t.Fatalf("reading the returned response body failed: %v", readErr)
+	}
+	if string(data) != "ok" {
+		t.Fatalf("got body %q, want %q", data, "ok")
+	}
+	result.resp.Body.Close()
+}
+
+func TestDispatcherIdempotencyGating(t *testing.T) {
+	d := newDispatcher(&DeadlineSpec{PerTry: "1s", MaxRetries: 3})
+	s := testServers(t)
+	ctx := newFakeContext(stdcontext.Background(), http.MethodPost)
+
+	var calls int32
+	_, err := d.do(ctx, s, func(tryCtx stdcontext.Context, server *Server) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, stdcontext.DeadlineExceeded
+	})
+
+	if err == nil {
+		t.Fatalf("expected the single failed POST attempt to surface as an error")
+	}
+	if calls != 1 {
+		t.Fatalf("POST is not idempotent by default, so it should not be retried: got %d attempts", calls)
+	}
+}
+
+func TestDispatcherIdempotencyGatingDisabled(t *testing.T) {
+	d := newDispatcher(&DeadlineSpec{
+		PerTry:              "1s",
+		MaxRetries:          2,
+		BackoffBase:         "1ms",
+		BackoffMax:          "2ms",
+		RetryIdempotentOnly: boolPtr(false),
+	})
+	s := testServers(t)
+	ctx := newFakeContext(stdcontext.Background(), http.MethodPost)
+
+	var calls int32
+	_, err := d.do(ctx, s, func(tryCtx stdcontext.Context, server *Server) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, stdcontext.DeadlineExceeded
+	})
+
+	if err == nil {
+		t.Fatalf("expected the exhausted retries to still surface an error")
+	}
+	if int(calls) != 1+d.spec.MaxRetries {
+		t.Fatalf("RetryIdempotentOnly=false should retry POST too: got %d attempts, want %d", calls, 1+d.spec.MaxRetries)
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
@@ -0,0 +1,394 @@
+package httpbackend
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegateway/pkg/logger"
+)
+
+const (
+	defaultHealthCheckInterval = "10s"
+	defaultHealthCheckTimeout  = "3s"
+	defaultHealthCheckPath     = "/"
+
+	defaultUnhealthyThreshold = 3
+	defaultHealthyThreshold   = 2
+
+	defaultBaseEjectionTime = "30s"
+	maxEjectionMultiplier   = 10
+)
+
+type (
+	// HealthCheck configures active health probing and passive outlier
+	// detection for backend servers.
+	HealthCheck struct {
+		// Interval is the time between two consecutive probes of the
+		// same server. Defaults to 10s.
+		Interval string `yaml:"interval" jsonschema:"omitempty,format=duration"`
+		// Timeout is the per-probe timeout. Defaults to 3s.
+		Timeout string `yaml:"timeout" jsonschema:"omitempty,format=duration"`
+		// Path is the HTTP path probed on every server. Defaults to "/".
+		Path string `yaml:"path" jsonschema:"omitempty"`
+		// ExpectedStatuses lists the status codes considered healthy.
+		// An empty list means any 2xx is healthy.
+		ExpectedStatuses []int `yaml:"expectedStatuses" jsonschema:"omitempty"`
+		// UnhealthyThreshold is the number of consecutive failed probes
+		// needed to mark a healthy server unhealthy. Defaults to 3.
+		UnhealthyThreshold int `yaml:"unhealthyThreshold" jsonschema:"omitempty,gte=1"`
+		// HealthyThreshold is the number of consecutive successful
+		// probes needed to mark an unhealthy server healthy again.
+		// Defaults to 2.
+		HealthyThreshold int `yaml:"healthyThreshold" jsonschema:"omitempty,gte=1"`
+
+		// TLSInsecureSkipVerify disables server certificate verification
+		// for HTTPS probes.
+		TLSInsecureSkipVerify bool `yaml:"tlsInsecureSkipVerify" jsonschema:"omitempty"`
+
+		// BaseEjectionTime is the starting ejection duration applied the
+		// first time a server is ejected for passive failures. Each
+		// ejection lasts the base times the number of times the server
+		// has been ejected so far, up to maxEjectionMultiplier times the
+		// base, mirroring Envoy's outlier detection. Defaults to 30s.
+		BaseEjectionTime string `yaml:"baseEjectionTime" jsonschema:"omitempty,format=duration"`
+		// ConsecutiveErrors is the number of passive failures within
+		// SlidingWindow needed to eject a server. Defaults to 5.
+		ConsecutiveErrors int `yaml:"consecutiveErrors" jsonschema:"omitempty,gte=1"`
+		// SlidingWindow is the window passive failures are counted over.
+		// Defaults to 30s.
+		SlidingWindow string `yaml:"slidingWindow" jsonschema:"omitempty,format=duration"`
+	}
+
+	// ServerHealth is the exported health state of one backend server.
+	ServerHealth struct {
+		URL              string `yaml:"url"`
+		Healthy          bool   `yaml:"healthy"`
+		Ejected          bool   `yaml:"ejected"`
+		ConsecutiveFails int    `yaml:"consecutiveFails"`
+		EjectionCount    int    `yaml:"ejectionCount"`
+		LastCheckTime    int64  `yaml:"lastCheckTime"`
+		LastError        string `yaml:"lastError,omitempty"`
+	}
+
+	healthChecker struct {
+		spec   *HealthCheck
+		client *http.Client
+
+		interval time.Duration
+		timeout  time.Duration
+
+		slidingWindow time.Duration
+		baseEjection  time.Duration
+
+		done chan struct{}
+
+		mutex   sync.Mutex
+		tracker map[string]*serverTracker
+	}
+
+	// serverTracker holds one server's health state. It is carried over
+	// across healthChecker generations by rebuild (see newHealthChecker),
+	// so it owns its own mutex rather than relying on its healthChecker's:
+	// the old and new generations' probe goroutines overlap for up to one
+	// probe timeout after a rebuild, and by then they no longer share a
+	// healthChecker to lock.
+	serverTracker struct {
+		server *Server
+
+		mu sync.Mutex
+
+		// active health check state.
+		healthy          int32 // 1 healthy, 0 unhealthy, accessed atomically
+		consecutiveOK    int
+		consecutiveFails int
+
+		// passive outlier detection state.
+		ejected        int32 // 1 ejected, 0 not, accessed atomically
+		ejectionCount  int
+		ejectedUntil   time.Time
+		windowStart    time.Time
+		windowFailures int
+
+		lastCheckTime int64
+		lastError     string
+	}
+)
+
+func stringDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// newHealthChecker builds a checker probing servers. When previous is not
+// nil, a server carried over from the prior generation (matched by URL)
+// keeps its existing tracker instead of starting over as healthy, so a
+// registry update that merely reshuffles the server list doesn't forget
+// which instances were ejected or mid-threshold.
+func newHealthChecker(spec *HealthCheck, servers []*Server, previous *healthChecker) *healthChecker {
+	if spec == nil {
+		return nil
+	}
+
+	interval, err := time.ParseDuration(stringDefault(spec.Interval, defaultHealthCheckInterval))
+	if err != nil {
+		logger.Errorf("BUG: parse health check interval %s failed: %v", spec.Interval, err)
+		interval, _ = time.ParseDuration(defaultHealthCheckInterval)
+	}
+
+	timeout, err := time.ParseDuration(stringDefault(spec.Timeout, defaultHealthCheckTimeout))
+	if err != nil {
+		logger.Errorf("BUG: parse health check timeout %s failed: %v", spec.Timeout, err)
+		timeout, _ = time.ParseDuration(defaultHealthCheckTimeout)
+	}
+
+	slidingWindow, err := time.ParseDuration(stringDefault(spec.SlidingWindow, "30s"))
+	if err != nil {
+		slidingWindow = 30 * time.Second
+	}
+
+	baseEjection, err := time.ParseDuration(stringDefault(spec.BaseEjectionTime, defaultBaseEjectionTime))
+	if err != nil {
+		baseEjection, _ = time.ParseDuration(defaultBaseEjectionTime)
+	}
+
+	hc := &healthChecker{
+		spec:          spec,
+		interval:      interval,
+		timeout:       timeout,
+		slidingWindow: slidingWindow,
+		baseEjection:  baseEjection,
+		done:          make(chan struct{}),
+		tracker:       make(map[string]*serverTracker, len(servers)),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: spec.TLSInsecureSkipVerify},
+			},
+		},
+	}
+
+	var previousTracker map[string]*serverTracker
+	if previous != nil {
+		previous.mutex.Lock()
+		previousTracker = previous.tracker
+		previous.mutex.Unlock()
+	}
+
+	for _, server := range servers {
+		if tracker, ok := previousTracker[server.URL]; ok {
+			hc.tracker[server.URL] = tracker
+		} else {
+			hc.tracker[server.URL] = &serverTracker{server: server, healthy: 1}
+		}
+		go hc.probeLoop(server)
+	}
+
+	return hc
+}
+
+func (hc *healthChecker) probeLoop(server *Server) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hc.done:
+			return
+		case <-ticker.C:
+			hc.probe(server)
+		}
+	}
+}
+
+func (hc *healthChecker) probe(server *Server) {
+	path := hc.spec.Path
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+
+	resp, err := hc.client.Get(server.URL + path)
+
+	hc.mutex.Lock()
+	tracker := hc.tracker[server.URL]
+	hc.mutex.Unlock()
+	if tracker == nil {
+		return
+	}
+
+	healthy := err == nil && hc.isExpectedStatus(resp.StatusCode)
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	tracker.mu.Lock()
+	tracker.lastCheckTime = time.Now().Unix()
+	if err != nil {
+		tracker.lastError = err.Error()
+	} else {
+		tracker.lastError = ""
+	}
+	tracker.mu.Unlock()
+
+	hc.recordActiveResult(tracker, healthy)
+}
+
+func (hc *healthChecker) isExpectedStatus(statusCode int) bool {
+	if len(hc.spec.ExpectedStatuses) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+
+	for _, expected := range hc.spec.ExpectedStatuses {
+		if expected == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (hc *healthChecker) recordActiveResult(tracker *serverTracker, healthy bool) {
+	unhealthyThreshold := hc.spec.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	healthyThreshold := hc.spec.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if healthy {
+		tracker.consecutiveFails = 0
+		tracker.consecutiveOK++
+		if atomic.LoadInt32(&tracker.healthy) == 0 && tracker.consecutiveOK >= healthyThreshold {
+			atomic.StoreInt32(&tracker.healthy, 1)
+		}
+		return
+	}
+
+	tracker.consecutiveOK = 0
+	tracker.consecutiveFails++
+	if atomic.LoadInt32(&tracker.healthy) == 1 && tracker.consecutiveFails >= unhealthyThreshold {
+		atomic.StoreInt32(&tracker.healthy, 0)
+	}
+}
+
+// recordPassiveFailure is called by the dispatch path when real traffic to
+// server observed a 5xx response or a connection error. Failures are
+// counted over a fixed window: it starts at the first failure after the
+// previous window has expired and is reset, not slid, once slidingWindow
+// has passed. Once consecutiveErrors failures land within the window the
+// server is ejected for baseEjectionTime times its ejection count, up to
+// maxEjectionMultiplier times the base.
+func (hc *healthChecker) recordPassiveFailure(server *Server) {
+	consecutiveErrors := hc.spec.ConsecutiveErrors
+	if consecutiveErrors <= 0 {
+		consecutiveErrors = 5
+	}
+
+	hc.mutex.Lock()
+	tracker := hc.tracker[server.URL]
+	hc.mutex.Unlock()
+	if tracker == nil {
+		return
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(tracker.windowStart) > hc.slidingWindow {
+		tracker.windowStart = now
+		tracker.windowFailures = 0
+	}
+	tracker.windowFailures++
+
+	if tracker.windowFailures < consecutiveErrors {
+		return
+	}
+
+	tracker.windowFailures = 0
+	tracker.ejectionCount++
+
+	multiplier := tracker.ejectionCount
+	if multiplier > maxEjectionMultiplier {
+		multiplier = maxEjectionMultiplier
+	}
+	ejectionTime := hc.baseEjection * time.Duration(multiplier)
+
+	tracker.ejectedUntil = now.Add(ejectionTime)
+	atomic.StoreInt32(&tracker.ejected, 1)
+}
+
+// isHealthy reports whether server should be considered for selection: it
+// must be passing active health checks and not currently ejected for
+// passive failures.
+func (hc *healthChecker) isHealthy(server *Server) bool {
+	if hc == nil {
+		return true
+	}
+
+	hc.mutex.Lock()
+	tracker := hc.tracker[server.URL]
+	hc.mutex.Unlock()
+	if tracker == nil {
+		return true
+	}
+
+	if atomic.LoadInt32(&tracker.ejected) == 1 {
+		tracker.mu.Lock()
+		expired := time.Now().After(tracker.ejectedUntil)
+		tracker.mu.Unlock()
+		if expired {
+			atomic.StoreInt32(&tracker.ejected, 0)
+		}
+		if !expired {
+			return false
+		}
+	}
+
+	return atomic.LoadInt32(&tracker.healthy) == 1
+}
+
+func (hc *healthChecker) status() []*ServerHealth {
+	if hc == nil {
+		return nil
+	}
+
+	hc.mutex.Lock()
+	trackers := make([]*serverTracker, 0, len(hc.tracker))
+	for _, tracker := range hc.tracker {
+		trackers = append(trackers, tracker)
+	}
+	hc.mutex.Unlock()
+
+	statuses := make([]*ServerHealth, 0, len(trackers))
+	for _, tracker := range trackers {
+		tracker.mu.Lock()
+		statuses = append(statuses, &ServerHealth{
+			URL:              tracker.server.URL,
+			Healthy:          atomic.LoadInt32(&tracker.healthy) == 1,
+			Ejected:          atomic.LoadInt32(&tracker.ejected) == 1,
+			ConsecutiveFails: tracker.consecutiveFails,
+			EjectionCount:    tracker.ejectionCount,
+			LastCheckTime:    tracker.lastCheckTime,
+			LastError:        tracker.lastError,
+		})
+		tracker.mu.Unlock()
+	}
+
+	return statuses
+}
+
+func (hc *healthChecker) close() {
+	if hc == nil {
+		return
+	}
+	close(hc.done)
+}
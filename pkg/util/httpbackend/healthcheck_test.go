@@ -0,0 +1,138 @@
+package httpbackend
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestHealthChecker(t *testing.T, spec *HealthCheck, servers []*Server) *healthChecker {
+	t.Helper()
+	// A long interval keeps probeLoop's ticker from firing network
+	// probes during the test; state transitions are driven directly
+	// through recordActiveResult/recordPassiveFailure instead.
+	if spec.Interval == "" {
+		spec.Interval = "1h"
+	}
+	hc := newHealthChecker(spec, servers, nil)
+	t.Cleanup(hc.close)
+	return hc
+}
+
+func TestHealthCheckerActiveThresholds(t *testing.T) {
+	server := &Server{URL: "http://s1"}
+	hc := newTestHealthChecker(t, &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}, []*Server{server})
+	tracker := hc.tracker[server.URL]
+
+	if !hc.isHealthy(server) {
+		t.Fatalf("server should start healthy")
+	}
+
+	hc.recordActiveResult(tracker, false)
+	if !hc.isHealthy(server) {
+		t.Fatalf("server should stay healthy below unhealthyThreshold")
+	}
+
+	hc.recordActiveResult(tracker, false)
+	if hc.isHealthy(server) {
+		t.Fatalf("server should be unhealthy after unhealthyThreshold consecutive failures")
+	}
+
+	hc.recordActiveResult(tracker, true)
+	if hc.isHealthy(server) {
+		t.Fatalf("server should stay unhealthy below healthyThreshold")
+	}
+
+	hc.recordActiveResult(tracker, true)
+	if !hc.isHealthy(server) {
+		t.Fatalf("server should recover after healthyThreshold consecutive successes")
+	}
+}
+
+func TestHealthCheckerActiveThresholdResetsOnMixedResults(t *testing.T) {
+	server := &Server{URL: "http://s1"}
+	hc := newTestHealthChecker(t, &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}, []*Server{server})
+	tracker := hc.tracker[server.URL]
+
+	hc.recordActiveResult(tracker, false)
+	hc.recordActiveResult(tracker, true)
+	hc.recordActiveResult(tracker, false)
+	if !hc.isHealthy(server) {
+		t.Fatalf("a single failure should not flip health once the streak is broken")
+	}
+}
+
+func TestHealthCheckerPassiveEjection(t *testing.T) {
+	server := &Server{URL: "http://s1"}
+	hc := newTestHealthChecker(t, &HealthCheck{
+		ConsecutiveErrors: 2,
+		SlidingWindow:     "1m",
+		BaseEjectionTime:  "20ms",
+	}, []*Server{server})
+
+	hc.recordPassiveFailure(server)
+	if !hc.isHealthy(server) {
+		t.Fatalf("server should not be ejected below consecutiveErrors")
+	}
+
+	hc.recordPassiveFailure(server)
+	if hc.isHealthy(server) {
+		t.Fatalf("server should be ejected once consecutiveErrors failures land in the window")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !hc.isHealthy(server) {
+		t.Fatalf("server should be un-ejected once baseEjectionTime elapses")
+	}
+}
+
+func TestHealthCheckerPassiveEjectionMultiplierCapped(t *testing.T) {
+	server := &Server{URL: "http://s1"}
+	hc := newTestHealthChecker(t, &HealthCheck{
+		ConsecutiveErrors: 1,
+		SlidingWindow:     "1m",
+		BaseEjectionTime:  "10ms",
+	}, []*Server{server})
+
+	tracker := hc.tracker[server.URL]
+	for i := 0; i < maxEjectionMultiplier+5; i++ {
+		hc.recordPassiveFailure(server)
+		tracker.mu.Lock()
+		tracker.ejectedUntil = time.Now()
+		tracker.mu.Unlock()
+	}
+
+	before := time.Now()
+	hc.recordPassiveFailure(server)
+	tracker.mu.Lock()
+	ejection := tracker.ejectedUntil.Sub(before)
+	tracker.mu.Unlock()
+	if ejection < 10*time.Millisecond*maxEjectionMultiplier || ejection > 10*time.Millisecond*(maxEjectionMultiplier+1) {
+		t.Fatalf("expected ejection time capped at %d x baseEjectionTime, got %s", maxEjectionMultiplier, ejection)
+	}
+
+	tracker.mu.Lock()
+	ejectionCount := tracker.ejectionCount
+	tracker.mu.Unlock()
+	if ejectionCount <= maxEjectionMultiplier {
+		t.Fatalf("expected ejectionCount to exceed maxEjectionMultiplier, got %d", ejectionCount)
+	}
+}
+
+func TestHealthCheckerRebuildCarriesOverTracker(t *testing.T) {
+	server := &Server{URL: "http://s1"}
+	spec := &HealthCheck{UnhealthyThreshold: 1, HealthyThreshold: 1, Interval: "1h"}
+	hc1 := newHealthChecker(spec, []*Server{server}, nil)
+
+	hc1.recordActiveResult(hc1.tracker[server.URL], false)
+	if hc1.isHealthy(server) {
+		t.Fatalf("setup: server should be unhealthy before rebuild")
+	}
+
+	hc2 := newHealthChecker(spec, []*Server{server}, hc1)
+	t.Cleanup(hc2.close)
+	hc1.close()
+
+	if hc2.isHealthy(server) {
+		t.Fatalf("a server carried over across rebuild should keep its unhealthy state")
+	}
+}
@@ -0,0 +1,71 @@
+package httpbackend
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegateway/pkg/object/serviceregistry"
+)
+
+// registryWatcher subscribes a servers set to a pkg/object/serviceregistry
+// backend, converting and pushing every update into the servers' snapshot
+// so data-plane traffic tracks registered instances without a config
+// reload.
+type registryWatcher struct {
+	done chan struct{}
+}
+
+func newRegistryWatcher(registryName, serviceName string, onUpdate func([]*Server)) *registryWatcher {
+	w := &registryWatcher{
+		done: make(chan struct{}),
+	}
+
+	updates := serviceregistry.Global.Watch(registryName, serviceName)
+
+	onUpdate(toBackendServers(serviceregistry.Global.ListServers(registryName, serviceName)))
+
+	go w.run(updates, onUpdate)
+
+	return w
+}
+
+func (w *registryWatcher) run(updates <-chan []*serviceregistry.Server, onUpdate func([]*Server)) {
+	for {
+		select {
+		case <-w.done:
+			return
+		case registryServers, ok := <-updates:
+			if !ok {
+				return
+			}
+			onUpdate(toBackendServers(registryServers))
+		}
+	}
+}
+
+func (w *registryWatcher) close() {
+	if w == nil {
+		return
+	}
+	close(w.done)
+}
+
+// toBackendServers converts service registry instances into httpbackend
+// Servers, carrying the registry's tags through so the existing
+// ServersTags filter keeps working for registry-sourced backends too.
+func toBackendServers(registryServers []*serviceregistry.Server) []*Server {
+	servers := make([]*Server, 0, len(registryServers))
+	for _, rs := range registryServers {
+		scheme := rs.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+
+		servers = append(servers, &Server{
+			URL:    fmt.Sprintf("%s://%s:%d", scheme, rs.HostIP, rs.Port),
+			Tags:   rs.Tags,
+			Weight: rs.Weight,
+		})
+	}
+
+	return servers
+}
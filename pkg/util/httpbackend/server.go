@@ -3,6 +3,7 @@ package httpbackend
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -17,19 +18,54 @@ func init() {
 }
 
 const (
-	policyRoundRobin     = "roundRobin"
-	policyRandom         = "random"
-	policyWeightedRandom = "weightedRandom"
-	policyIPHash         = "ipHash"
-	policyHeaderHash     = "headerHash"
+	policyRoundRobin       = "roundRobin"
+	policyRandom           = "random"
+	policyWeightedRandom   = "weightedRandom"
+	policyIPHash           = "ipHash"
+	policyHeaderHash       = "headerHash"
+	policyConsistentHash   = "consistentHash"
+	policyLeastConnections = "leastConnections"
+	policySubsets          = "subsets"
+
+	keySourceIPHash = "ip"
+	keySourceHeader = "header"
+	keySourceField  = "field"
+
+	defaultVirtualNodeReplicas = 100
 )
 
 type (
 	servers struct {
-		count      uint64
-		weightsSum int
-		servers    []*Server
-		lb         *LoadBalance
+		count uint64
+		lb    *LoadBalance
+
+		serversTags []string
+		healthCheck *HealthCheck
+
+		// snap is the current *snapshot, swapped atomically so next()
+		// stays lock-free even while a service registry subscription is
+		// replacing the server set concurrently.
+		snap atomic.Value
+
+		registry *registryWatcher
+		subsets  *subsetRouter
+	}
+
+	// snapshot is the immutable view of the server set next() picks
+	// from; a new one is built and stored whenever the configured
+	// servers change, whether from a static Spec.Servers or a service
+	// registry update. checker lives here, rather than as a separate
+	// *servers field, so it is swapped atomically along with everything
+	// else next()/release() read and there is no window where one goroutine
+	// reads a checker a concurrent rebuild() is replacing.
+	snapshot struct {
+		servers      []*Server
+		weightsSum   int
+		ring         *consistentHashRing
+		subsetRings  map[string]*consistentHashRing
+		serverIndex  map[*Server]int
+		connCounters []int64
+		checker      *healthChecker
 	}
 
 	// Server is backend server.
@@ -43,8 +79,31 @@ type (
 	LoadBalance struct {
 		V string `yaml:"-" v:"parent"`
 
-		Policy        string `yaml:"policy" v:"required,oneof=roundRobin random weightedRandom ipHash headerHash"`
+		Policy        string `yaml:"policy" v:"required,oneof=roundRobin random weightedRandom ipHash headerHash consistentHash leastConnections subsets"`
 		HeaderHashKey string `yaml:"headerHashKey"`
+
+		// ConsistentHash configures the ketama-style hash ring used by
+		// the consistentHash policy.
+		ConsistentHash *ConsistentHashSpec `yaml:"consistentHash"`
+
+		// Subsets configures tag-based subset routing for the subsets
+		// policy.
+		Subsets *SubsetsSpec `yaml:"subsets"`
+	}
+
+	// ConsistentHashSpec configures the consistentHash policy.
+	ConsistentHashSpec struct {
+		// VirtualNodeReplicas is the number of virtual nodes placed on
+		// the ring per server weight unit. Defaults to 100.
+		VirtualNodeReplicas int `yaml:"virtualNodeReplicas" v:"gte=0"`
+
+		// KeySource is where the hash key is taken from: ip, header or
+		// field. Defaults to ip.
+		KeySource string `yaml:"keySource" v:"omitempty,oneof=ip header field"`
+
+		// Key is the header name or query parameter name to hash on,
+		// required when KeySource is header or field.
+		Key string `yaml:"key"`
 	}
 )
 
@@ -54,75 +113,210 @@ func (lb LoadBalance) Validate() error {
 		return fmt.Errorf("headerHash needs to speficy headerHashKey")
 	}
 
+	if lb.Policy == policyConsistentHash {
+		ch := lb.ConsistentHash
+		if ch != nil && (ch.KeySource == keySourceHeader || ch.KeySource == keySourceField) && len(ch.Key) == 0 {
+			return fmt.Errorf("consistentHash with keySource %s needs to specify key", ch.KeySource)
+		}
+	}
+
+	if lb.Policy == policySubsets {
+		if lb.Subsets == nil {
+			return fmt.Errorf("subsets needs to specify subsets config")
+		}
+
+		names := map[string]struct{}{}
+		for _, subset := range lb.Subsets.Subsets {
+			names[subset.Name] = struct{}{}
+		}
+		if _, ok := names[lb.Subsets.Fallback]; !ok {
+			return fmt.Errorf("subsets fallback %s is not a declared subset", lb.Subsets.Fallback)
+		}
+		for _, rule := range lb.Subsets.Rules {
+			if _, ok := names[rule.Subset]; !ok {
+				return fmt.Errorf("subsets rule references undeclared subset %s", rule.Subset)
+			}
+		}
+
+		if lb.Subsets.Policy == policyConsistentHash {
+			ch := lb.Subsets.ConsistentHash
+			if ch != nil && (ch.KeySource == keySourceHeader || ch.KeySource == keySourceField) && len(ch.Key) == 0 {
+				return fmt.Errorf("subsets consistentHash with keySource %s needs to specify key", ch.KeySource)
+			}
+		}
+	}
+
 	return nil
 }
 
 func newServers(spec *Spec) *servers {
 	s := &servers{
-		lb: spec.LoadBalance,
+		lb:          spec.LoadBalance,
+		serversTags: spec.ServersTags,
+		healthCheck: spec.HealthCheck,
+	}
+
+	if spec.LoadBalance != nil && spec.LoadBalance.Policy == policySubsets {
+		s.subsets = newSubsetRouter(spec.LoadBalance.Subsets)
 	}
-	defer s.prepare()
 
-	if len(spec.ServersTags) == 0 {
-		s.servers = spec.Servers
+	if spec.ServiceRegistry != "" {
+		s.registry = newRegistryWatcher(spec.ServiceRegistry, spec.ServiceName, s.rebuild)
 		return s
 	}
 
-	servers := make([]*Server, 0)
-	for _, server := range spec.Servers {
-		for _, tag := range spec.ServersTags {
-			if common.StrInSlice(tag, server.Tags) {
-				servers = append(servers, server)
-				break
+	s.rebuild(spec.Servers)
+
+	return s
+}
+
+// rebuild filters list by the configured ServersTags, builds a fresh
+// snapshot (weights, hash ring, per-server counters, health checker) and
+// swaps it in atomically. It is the single place both the static
+// Spec.Servers path and registry updates funnel through, so next() always
+// sees a consistent view.
+func (s *servers) rebuild(list []*Server) {
+	filtered := list
+	if len(s.serversTags) > 0 {
+		filtered = make([]*Server, 0, len(list))
+		for _, server := range list {
+			for _, tag := range s.serversTags {
+				if common.StrInSlice(tag, server.Tags) {
+					filtered = append(filtered, server)
+					break
+				}
 			}
 		}
 	}
-	s.servers = servers
 
-	return s
-}
+	snap := &snapshot{servers: filtered}
+
+	for _, server := range filtered {
+		snap.weightsSum += server.Weight
+	}
+
+	snap.serverIndex = make(map[*Server]int, len(filtered))
+	for i, server := range filtered {
+		snap.serverIndex[server] = i
+	}
+	snap.connCounters = make([]int64, len(filtered))
+
+	if s.lb != nil && s.lb.Policy == policyConsistentHash {
+		snap.ring = newConsistentHashRing(filtered, s.lb.ConsistentHash)
+	}
+
+	if s.subsets != nil && s.subsets.spec.Policy == policyConsistentHash {
+		snap.subsetRings = make(map[string]*consistentHashRing, len(s.subsets.spec.Subsets))
+		for _, subset := range s.subsets.spec.Subsets {
+			members := s.subsets.subsetOf(snap, subset.Name)
+			snap.subsetRings[subset.Name] = newConsistentHashRing(members, s.subsets.spec.ConsistentHash)
+		}
+	}
 
-func (s *servers) prepare() {
-	for _, server := range s.servers {
-		s.weightsSum += server.Weight
+	var previousChecker *healthChecker
+	if previous, ok := s.snap.Load().(*snapshot); ok {
+		previousChecker = previous.checker
 	}
+	// Carry over tracker state for servers present in both generations,
+	// so an instance flagged unhealthy or ejected doesn't get reset to
+	// healthy just because a registry update reshuffled the server list.
+	snap.checker = newHealthChecker(s.healthCheck, filtered, previousChecker)
+
+	s.snap.Store(snap)
+
+	previousChecker.close()
+}
+
+func (s *servers) current() *snapshot {
+	return s.snap.Load().(*snapshot)
 }
 
 func (s *servers) len() int {
-	return len(s.servers)
+	return len(s.current().servers)
 }
 
 func (s *servers) next(ctx context.HTTPContext) *Server {
+	snap := s.current()
+	server := s.pick(ctx, snap)
+
+	if server == nil || snap.checker == nil || snap.checker.isHealthy(server) {
+		return server
+	}
+
+	// The policy's first choice is unhealthy or ejected: fall back to the
+	// first healthy server found scanning from a random offset, rather
+	// than forcing traffic onto a known-bad backend. For the subsets
+	// policy this scan is not subset-scoped, so an unhealthy pick can
+	// spill over into another subset; that's preferable to a failed
+	// request and is rare once passive ejection stabilizes.
+	n := len(snap.servers)
+	offset := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		candidate := snap.servers[(offset+i)%n]
+		if snap.checker.isHealthy(candidate) {
+			s.swapPickBookkeeping(server, candidate, snap)
+			return candidate
+		}
+	}
+
+	logger.Errorf("BUG: no healthy server among %d servers, falling back to %s", n, server.URL)
+	return server
+}
+
+// swapPickBookkeeping undoes pick()'s per-server bookkeeping for discarded
+// (the unhealthy first choice) and applies it to substitute instead, so
+// counters like leastConnections' in-flight count stay accurate and the
+// eventual release() call balances against the server actually used rather
+// than leaking a count on the discarded server.
+func (s *servers) swapPickBookkeeping(discarded, substitute *Server, snap *snapshot) {
+	if discarded == substitute {
+		return
+	}
+	if i, ok := snap.serverIndex[discarded]; ok {
+		atomic.AddInt64(&snap.connCounters[i], -1)
+	}
+	if j, ok := snap.serverIndex[substitute]; ok {
+		atomic.AddInt64(&snap.connCounters[j], 1)
+	}
+}
+
+func (s *servers) pick(ctx context.HTTPContext, snap *snapshot) *Server {
 	switch s.lb.Policy {
 	case policyRoundRobin:
-		return s.roundRobin(ctx)
+		return s.roundRobin(ctx, snap)
 	case policyRandom:
-		return s.random(ctx)
+		return s.random(ctx, snap)
 	case policyWeightedRandom:
-		return s.weightedRandom(ctx)
+		return s.weightedRandom(ctx, snap)
 	case policyIPHash:
-		return s.ipHash(ctx)
+		return s.ipHash(ctx, snap)
 	case policyHeaderHash:
-		return s.headerHash(ctx)
+		return s.headerHash(ctx, snap)
+	case policyConsistentHash:
+		return s.consistentHash(ctx, snap)
+	case policyLeastConnections:
+		return s.leastConnections(ctx, snap)
+	case policySubsets:
+		return s.subsets.pick(ctx, snap, snap.checker)
 	}
 
 	logger.Errorf("BUG: unknown load balance policy: %s", s.lb.Policy)
 
-	return s.roundRobin(ctx)
+	return s.roundRobin(ctx, snap)
 }
 
-func (s *servers) roundRobin(ctx context.HTTPContext) *Server {
+func (s *servers) roundRobin(ctx context.HTTPContext, snap *snapshot) *Server {
 	count := atomic.AddUint64(&s.count, 1)
-	return s.servers[int(count)%len(s.servers)]
+	return snap.servers[int(count)%len(snap.servers)]
 }
 
-func (s *servers) random(ctx context.HTTPContext) *Server {
-	return s.servers[rand.Intn(len(s.servers))]
+func (s *servers) random(ctx context.HTTPContext, snap *snapshot) *Server {
+	return snap.servers[rand.Intn(len(snap.servers))]
 }
 
-func (s *servers) weightedRandom(ctx context.HTTPContext) *Server {
-	randomWeight := rand.Intn(s.weightsSum)
-	for _, server := range s.servers {
+func (s *servers) weightedRandom(ctx context.HTTPContext, snap *snapshot) *Server {
+	randomWeight := rand.Intn(snap.weightsSum)
+	for _, server := range snap.servers {
 		randomWeight -= server.Weight
 		if randomWeight < 0 {
 			return server
@@ -130,18 +324,169 @@ func (s *servers) weightedRandom(ctx context.HTTPContext) *Server {
 	}
 
 	logger.Errorf("BUG: weighted random can't pick a server: sum(%d) servers(%+v)",
-		s.weightsSum, s.servers)
+		snap.weightsSum, snap.servers)
 
-	return s.random(ctx)
+	return s.random(ctx, snap)
 }
 
-func (s *servers) ipHash(ctx context.HTTPContext) *Server {
+func (s *servers) ipHash(ctx context.HTTPContext, snap *snapshot) *Server {
 	sum32 := int(hashtool.Hash32(ctx.Request().RealIP()))
-	return s.servers[sum32%len(s.servers)]
+	return snap.servers[sum32%len(snap.servers)]
 }
 
-func (s *servers) headerHash(ctx context.HTTPContext) *Server {
+func (s *servers) headerHash(ctx context.HTTPContext, snap *snapshot) *Server {
 	value := ctx.Request().Header().Get(s.lb.HeaderHashKey)
 	sum32 := int(hashtool.Hash32(value))
-	return s.servers[sum32%len(s.servers)]
+	return snap.servers[sum32%len(snap.servers)]
+}
+
+func (s *servers) consistentHash(ctx context.HTTPContext, snap *snapshot) *Server {
+	key := consistentHashKeyOf(ctx, s.lb.ConsistentHash)
+	return snap.ring.pick(key)
+}
+
+// consistentHashKeyOf extracts the hash key for ch from ctx, shared by the
+// servers-wide consistentHash policy and the per-subset one.
+func consistentHashKeyOf(ctx context.HTTPContext, ch *ConsistentHashSpec) string {
+	if ch == nil {
+		return ctx.Request().RealIP()
+	}
+
+	switch ch.KeySource {
+	case keySourceHeader:
+		return ctx.Request().Header().Get(ch.Key)
+	case keySourceField:
+		return ctx.Request().QueryParam(ch.Key)
+	default:
+		return ctx.Request().RealIP()
+	}
+}
+
+// leastConnections picks the server with fewer in-flight requests between
+// two random candidates (power of two choices), which gives results close
+// to true least-connections without scanning every server on each request.
+// Callers must invoke release once the associated request completes so the
+// counter stays accurate even when the client cancels early.
+func (s *servers) leastConnections(ctx context.HTTPContext, snap *snapshot) *Server {
+	n := len(snap.servers)
+	if n == 1 {
+		atomic.AddInt64(&snap.connCounters[0], 1)
+		return snap.servers[0]
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n)
+	for j == i {
+		j = rand.Intn(n)
+	}
+
+	picked := i
+	if atomic.LoadInt64(&snap.connCounters[j]) < atomic.LoadInt64(&snap.connCounters[i]) {
+		picked = j
+	}
+
+	atomic.AddInt64(&snap.connCounters[picked], 1)
+	return snap.servers[picked]
+}
+
+// release decrements the in-flight request counter for server. It is a
+// no-op for servers not tracked by the current snapshot (e.g. a previous
+// generation of servers swapped out concurrently by a registry update). It
+// is not idempotent: every call decrements the counter once more.
+func (s *servers) release(server *Server) {
+	if server == nil {
+		return
+	}
+
+	snap := s.current()
+	i, ok := snap.serverIndex[server]
+	if !ok {
+		return
+	}
+
+	atomic.AddInt64(&snap.connCounters[i], -1)
+}
+
+// recordFailure reports a passive failure (5xx or connection error)
+// observed on real traffic to server, feeding the health checker's outlier
+// detection. It is a no-op when no HealthCheck is configured.
+func (s *servers) recordFailure(server *Server) {
+	checker := s.current().checker
+	if checker == nil {
+		return
+	}
+	checker.recordPassiveFailure(server)
+}
+
+// health returns the current per-server health state, or nil when no
+// HealthCheck is configured.
+func (s *servers) health() []*ServerHealth {
+	return s.current().checker.status()
+}
+
+// close stops the health checker's probe goroutines and, if this server set
+// is driven by a service registry, unsubscribes from it.
+func (s *servers) close() {
+	s.current().checker.close()
+	s.registry.close()
+}
+
+type (
+	consistentHashRing struct {
+		nodes []ringNode
+	}
+
+	ringNode struct {
+		hash   uint32
+		server *Server
+	}
+)
+
+// newConsistentHashRing builds a ketama-style hash ring: each server gets a
+// number of virtual nodes proportional to its weight so lookups land on
+// heavier servers more often, and adding or removing a server only
+// reshuffles the keys that mapped to its virtual nodes.
+func newConsistentHashRing(servers []*Server, spec *ConsistentHashSpec) *consistentHashRing {
+	replicas := defaultVirtualNodeReplicas
+	if spec != nil && spec.VirtualNodeReplicas > 0 {
+		replicas = spec.VirtualNodeReplicas
+	}
+
+	ring := &consistentHashRing{}
+	for _, server := range servers {
+		weight := server.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		for i := 0; i < replicas*weight; i++ {
+			vnodeKey := fmt.Sprintf("%s-%d", server.URL, i)
+			ring.nodes = append(ring.nodes, ringNode{
+				hash:   hashtool.Hash32(vnodeKey),
+				server: server,
+			})
+		}
+	}
+
+	sort.Slice(ring.nodes, func(i, j int) bool {
+		return ring.nodes[i].hash < ring.nodes[j].hash
+	})
+
+	return ring
+}
+
+func (r *consistentHashRing) pick(key string) *Server {
+	if len(r.nodes) == 0 {
+		return nil
+	}
+
+	hash := hashtool.Hash32(key)
+	i := sort.Search(len(r.nodes), func(i int) bool {
+		return r.nodes[i].hash >= hash
+	})
+	if i == len(r.nodes) {
+		i = 0
+	}
+
+	return r.nodes[i].server
 }
\ No newline at end of file
@@ -0,0 +1,52 @@
+package httpbackend
+
+import "fmt"
+
+type (
+	// Spec describes the httpbackend filter.
+	Spec struct {
+		V string `yaml:"-" v:"parent"`
+
+		// Servers is a static backend list. Mutually exclusive with
+		// ServiceRegistry.
+		Servers     []*Server    `yaml:"servers" v:"omitempty,dive"`
+		ServersTags []string     `yaml:"serversTags"`
+		LoadBalance *LoadBalance `yaml:"loadBalance"`
+
+		// HealthCheck enables active probing and passive outlier
+		// detection for Servers. Disabled when omitted.
+		HealthCheck *HealthCheck `yaml:"healthCheck,omitempty"`
+
+		// ServiceRegistry names a registered serviceregistry object
+		// (e.g. an EurekaServiceRegistry) backends are discovered from
+		// instead of the static Servers list.
+		ServiceRegistry string `yaml:"serviceRegistry,omitempty"`
+		// ServiceName is the application/service name to look up in
+		// ServiceRegistry. Required when ServiceRegistry is set.
+		ServiceName string `yaml:"serviceName,omitempty"`
+
+		// Deadline bounds how long dispatch may spend across all
+		// tries and controls retries. Disabled when omitted, meaning a
+		// single, unbounded try against the first picked server.
+		Deadline *DeadlineSpec `yaml:"deadline,omitempty"`
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	if spec.ServiceRegistry != "" {
+		if spec.ServiceName == "" {
+			return fmt.Errorf("serviceRegistry needs to specify serviceName")
+		}
+		if len(spec.Servers) != 0 {
+			return fmt.Errorf("serviceRegistry and servers are mutually exclusive")
+		}
+		return nil
+	}
+
+	if len(spec.Servers) == 0 {
+		return fmt.Errorf("servers or serviceRegistry is required")
+	}
+
+	return nil
+}
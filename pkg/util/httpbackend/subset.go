@@ -0,0 +1,314 @@
+package httpbackend
+
+import (
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"github.com/megaease/easegateway/pkg/common"
+	"github.com/megaease/easegateway/pkg/context"
+	"github.com/megaease/easegateway/pkg/logger"
+)
+
+type (
+	// SubsetsSpec configures tag-based subset routing, letting a single
+	// backend filter split traffic across named groups of servers (e.g.
+	// a canary or blue/green variant) without a separate filter chain
+	// per variant.
+	SubsetsSpec struct {
+		// Subsets declares the named server groups, selected by tag.
+		Subsets []*SubsetSpec `yaml:"subsets" v:"required,dive"`
+		// Rules maps request predicates to a subset, evaluated in
+		// order; the first match wins.
+		Rules []*SubsetRuleSpec `yaml:"rules" v:"required,dive"`
+		// Fallback is the subset used when no rule matches, or the
+		// matched subset has no healthy servers.
+		Fallback string `yaml:"fallback" jsonschema:"required"`
+		// Policy is the load balance policy applied among the servers
+		// of the selected subset. Defaults to roundRobin.
+		Policy string `yaml:"policy" v:"omitempty,oneof=roundRobin random weightedRandom consistentHash leastConnections"`
+		// ConsistentHash configures the hash ring used when Policy is
+		// consistentHash.
+		ConsistentHash *ConsistentHashSpec `yaml:"consistentHash"`
+	}
+
+	// SubsetSpec names a group of servers selected by tag, e.g.
+	// ["version=canary"].
+	SubsetSpec struct {
+		Name string   `yaml:"name" v:"required"`
+		Tags []string `yaml:"tags" v:"required,unique,dive,required"`
+	}
+
+	// SubsetRuleSpec maps a request predicate to a subset. Headers and
+	// QueryParams must all match (when set); PathPrefix must prefix the
+	// request path (when set). A rule with none of those set and only a
+	// Weight acts as a weighted-random split among its peers, letting
+	// canary rollouts shift traffic by percentage instead of a hard
+	// predicate.
+	SubsetRuleSpec struct {
+		Subset      string            `yaml:"subset" v:"required"`
+		Headers     map[string]string `yaml:"headers,omitempty"`
+		PathPrefix  string            `yaml:"pathPrefix,omitempty"`
+		QueryParams map[string]string `yaml:"queryParams,omitempty"`
+		Weight      int               `yaml:"weight,omitempty" v:"gte=0,lte=100"`
+	}
+
+	// subsetRouter picks a subset for a request and then a server within
+	// it by the configured policy; roundRobin uses a counter scoped to
+	// that subset.
+	subsetRouter struct {
+		spec *SubsetsSpec
+
+		weightRules []*SubsetRuleSpec
+		weightSum   int
+
+		// counters is fixed at construction time (one entry per rule
+		// subset plus the fallback), so round-robin only ever touches
+		// the *uint64 via atomic ops, no locking needed.
+		counters map[string]*uint64
+	}
+)
+
+func newSubsetRouter(spec *SubsetsSpec) *subsetRouter {
+	if spec == nil {
+		return nil
+	}
+
+	r := &subsetRouter{
+		spec:     spec,
+		counters: make(map[string]*uint64),
+	}
+
+	for _, rule := range spec.Rules {
+		if len(rule.Headers) == 0 && rule.PathPrefix == "" && len(rule.QueryParams) == 0 && rule.Weight > 0 {
+			r.weightRules = append(r.weightRules, rule)
+			r.weightSum += rule.Weight
+		}
+		if _, ok := r.counters[rule.Subset]; !ok {
+			var count uint64
+			r.counters[rule.Subset] = &count
+		}
+	}
+	if _, ok := r.counters[spec.Fallback]; !ok {
+		var count uint64
+		r.counters[spec.Fallback] = &count
+	}
+
+	return r
+}
+
+// subsetOf selects the members of the snapshot's server list that carry all
+// tags of the named subset. An unknown subset name yields no servers.
+func (r *subsetRouter) subsetOf(snap *snapshot, name string) []*Server {
+	var tags []string
+	for _, subset := range r.spec.Subsets {
+		if subset.Name == name {
+			tags = subset.Tags
+			break
+		}
+	}
+	if tags == nil {
+		return nil
+	}
+
+	var members []*Server
+	for _, server := range snap.servers {
+		matches := true
+		for _, tag := range tags {
+			if !common.StrInSlice(tag, server.Tags) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			members = append(members, server)
+		}
+	}
+
+	return members
+}
+
+// selectSubsetName evaluates Rules against ctx in order, falling back to a
+// weighted split among weight-only rules, then to spec.Fallback.
+func (r *subsetRouter) selectSubsetName(ctx context.HTTPContext) string {
+	for _, rule := range r.spec.Rules {
+		if len(rule.Headers) == 0 && rule.PathPrefix == "" && len(rule.QueryParams) == 0 && rule.Weight > 0 {
+			continue // weight-only rules are only considered if nothing else matches
+		}
+		if r.ruleMatches(rule, ctx) {
+			return rule.Subset
+		}
+	}
+
+	if len(r.weightRules) > 0 {
+		randomWeight := rand.Intn(r.weightSum)
+		for _, rule := range r.weightRules {
+			randomWeight -= rule.Weight
+			if randomWeight < 0 {
+				return rule.Subset
+			}
+		}
+	}
+
+	return r.spec.Fallback
+}
+
+func (r *subsetRouter) ruleMatches(rule *SubsetRuleSpec, ctx context.HTTPContext) bool {
+	for name, value := range rule.Headers {
+		if ctx.Request().Header().Get(name) != value {
+			return false
+		}
+	}
+
+	if rule.PathPrefix != "" && !strings.HasPrefix(ctx.Request().Path(), rule.PathPrefix) {
+		return false
+	}
+
+	for name, value := range rule.QueryParams {
+		if ctx.Request().QueryParam(name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pick selects a subset name for ctx, then returns one of its healthy
+// members via the configured intra-subset policy, falling back to
+// spec.Fallback when the chosen subset has no healthy servers. checker may
+// be nil when no HealthCheck is configured, in which case every member is
+// considered healthy.
+func (r *subsetRouter) pick(ctx context.HTTPContext, snap *snapshot, checker *healthChecker) *Server {
+	name := r.selectSubsetName(ctx)
+
+	members := r.healthyMembersOf(snap, name, checker)
+	if len(members) == 0 && name != r.spec.Fallback {
+		name = r.spec.Fallback
+		members = r.healthyMembersOf(snap, name, checker)
+	}
+
+	if len(members) == 0 {
+		// Neither the matched subset nor the fallback has a healthy
+		// server left; pick from the fallback subset's full member
+		// list. next() still replaces such an unhealthy pick with any
+		// healthy server, which may belong to another subset.
+		members = r.subsetOf(snap, name)
+	}
+
+	if len(members) == 0 {
+		logger.Errorf("BUG: subset %s has no servers", name)
+		return nil
+	}
+
+	switch r.spec.Policy {
+	case policyRandom:
+		return members[rand.Intn(len(members))]
+	case policyWeightedRandom:
+		return r.weightedRandomOf(members)
+	case policyConsistentHash:
+		return r.consistentHashOf(ctx, snap, name, checker)
+	case policyLeastConnections:
+		return r.leastConnectionsOf(members, snap)
+	default:
+		count := atomic.AddUint64(r.counters[name], 1)
+		return members[int(count)%len(members)]
+	}
+}
+
+// healthyMembersOf returns the named subset's members that are currently
+// healthy, per checker.
+func (r *subsetRouter) healthyMembersOf(snap *snapshot, name string, checker *healthChecker) []*Server {
+	all := r.subsetOf(snap, name)
+	if checker == nil {
+		return all
+	}
+
+	healthy := make([]*Server, 0, len(all))
+	for _, server := range all {
+		if checker.isHealthy(server) {
+			healthy = append(healthy, server)
+		}
+	}
+	return healthy
+}
+
+// consistentHashOf hashes ctx onto name's ring, cached in snap.subsetRings
+// at rebuild time and reused across requests until the server set changes,
+// the same way the servers-wide consistentHash policy caches snap.ring.
+// Unlike snap.ring's next() fallback, which scans the whole server list and
+// can spill into another subset, an unhealthy ring pick here is replaced by a
+// healthy member of name's own subset; when no member is healthy the
+// unhealthy pick is returned as is.
+func (r *subsetRouter) consistentHashOf(ctx context.HTTPContext, snap *snapshot, name string, checker *healthChecker) *Server {
+	ring := snap.subsetRings[name]
+	if ring == nil {
+		return nil
+	}
+
+	key := consistentHashKeyOf(ctx, r.spec.ConsistentHash)
+	server := ring.pick(key)
+	if server == nil || checker == nil || checker.isHealthy(server) {
+		return server
+	}
+
+	members := r.subsetOf(snap, name)
+	n := len(members)
+	if n == 0 {
+		return server
+	}
+
+	offset := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		candidate := members[(offset+i)%n]
+		if checker.isHealthy(candidate) {
+			return candidate
+		}
+	}
+
+	return server
+}
+
+// leastConnectionsOf applies the same power-of-two-choices selection as
+// servers.leastConnections, scoped to members, reusing snap's connCounters
+// since members are drawn straight from snap.servers.
+func (r *subsetRouter) leastConnectionsOf(members []*Server, snap *snapshot) *Server {
+	n := len(members)
+	if n == 1 {
+		atomic.AddInt64(&snap.connCounters[snap.serverIndex[members[0]]], 1)
+		return members[0]
+	}
+
+	a := members[rand.Intn(n)]
+	b := members[rand.Intn(n)]
+	for b == a {
+		b = members[rand.Intn(n)]
+	}
+
+	picked := a
+	if atomic.LoadInt64(&snap.connCounters[snap.serverIndex[b]]) < atomic.LoadInt64(&snap.connCounters[snap.serverIndex[a]]) {
+		picked = b
+	}
+
+	atomic.AddInt64(&snap.connCounters[snap.serverIndex[picked]], 1)
+	return picked
+}
+
+func (r *subsetRouter) weightedRandomOf(members []*Server) *Server {
+	sum := 0
+	for _, server := range members {
+		sum += server.Weight
+	}
+	if sum <= 0 {
+		return members[rand.Intn(len(members))]
+	}
+
+	randomWeight := rand.Intn(sum)
+	for _, server := range members {
+		randomWeight -= server.Weight
+		if randomWeight < 0 {
+			return server
+		}
+	}
+
+	return members[len(members)-1]
+}